@@ -0,0 +1,108 @@
+// Copyright 2009 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt
+
+import "plan9/p"
+import "io"
+import "os"
+import "runtime"
+import "syscall"
+
+// authrw adapts an afid to io.ReadWriter so that an external auth
+// mechanism (P9SK1, DIGEST-MD5, a TLS-derived token exchange, ...) can
+// drive Tread/Twrite against it without knowing anything about 9P.
+type authrw struct {
+	clnt	*Clnt;
+	afid	*Fid;
+}
+
+func (rw *authrw) Read(buf []byte) (int, os.Error) {
+	tc := p.NewFcall(rw.clnt.Msize);
+	err := p.PackTread(tc, rw.afid.Fid, 0, uint32(len(buf)));
+	if err != nil {
+		return 0, os.NewError("9p: auth read failed")
+	}
+
+	rc, err := rw.clnt.rpc(tc);
+	if err != nil {
+		return 0, os.NewError("9p: auth read failed")
+	}
+
+	return copy(buf, rc.Data), nil;
+}
+
+func (rw *authrw) Write(buf []byte) (int, os.Error) {
+	tc := p.NewFcall(rw.clnt.Msize);
+	err := p.PackTwrite(tc, rw.afid.Fid, 0, buf);
+	if err != nil {
+		return 0, os.NewError("9p: auth write failed")
+	}
+
+	rc, err := rw.clnt.rpc(tc);
+	if err != nil {
+		return 0, os.NewError("9p: auth write failed")
+	}
+
+	return int(rc.Count), nil;
+}
+
+// Auth performs a Tauth for uname/aname and then hands the resulting
+// afid to authFunc as a plain io.ReadWriter, so authFunc can run
+// whatever challenge/response protocol the server expects over it.
+// Returns the authenticated afid, ready to be passed to AttachAuth.
+func (clnt *Clnt) Auth(uname, aname string, authFunc func(io.ReadWriter) os.Error) (*Fid, *p.Error) {
+	afid := clnt.newFid();
+	tc := p.NewFcall(clnt.Msize);
+	err := p.PackTauth(tc, afid.Fid, uname, aname);
+	if err != nil {
+		// Disarm the leak finalizer before the id goes back to
+		// fidpool, same as Remove: otherwise a later fid
+		// reusing the same number could get erroneously clunked by
+		// this afid's finalizer once it runs.
+		runtime.SetFinalizer(afid, nil);
+		clnt.fidpool.putId(afid.Fid);
+		return nil, err
+	}
+
+	rc, err := clnt.rpc(tc);
+	if err != nil {
+		runtime.SetFinalizer(afid, nil);
+		clnt.fidpool.putId(afid.Fid);
+		return nil, err
+	}
+
+	afid.Qid = rc.Aqid;
+	if authFunc != nil {
+		if aerr := authFunc(&authrw{clnt, afid}); aerr != nil {
+			return afid, &p.Error{aerr.String(), uint32(syscall.EIO)}
+		}
+	}
+
+	return afid, nil;
+}
+
+// AttachAuth is like the plain Attach, but presents afid (obtained
+// from Auth) so the server's Fsrv.Authsrv can verify it before
+// handing out the tree.
+func (clnt *Clnt) AttachAuth(afid *Fid, uname, aname string) (*Fid, *p.Error) {
+	fid := clnt.newFid();
+	tc := p.NewFcall(clnt.Msize);
+	err := p.PackTattach(tc, fid.Fid, afid.Fid, uname, aname);
+	if err != nil {
+		runtime.SetFinalizer(fid, nil);
+		clnt.fidpool.putId(fid.Fid);
+		return nil, err
+	}
+
+	rc, err := clnt.rpc(tc);
+	if err != nil {
+		runtime.SetFinalizer(fid, nil);
+		clnt.fidpool.putId(fid.Fid);
+		return nil, err
+	}
+
+	fid.Qid = rc.Qid;
+	return fid, nil;
+}
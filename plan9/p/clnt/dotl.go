@@ -0,0 +1,268 @@
+// Copyright 2009 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt
+
+import "plan9/p"
+
+// Getattr fetches the attributes named by mask for fid via Tgetattr.
+func (clnt *Clnt) Getattr(fid *Fid, mask uint64) (*p.Dotlstat, *p.Error) {
+	tc := p.NewFcall(clnt.Msize);
+	err := p.PackTgetattr(tc, fid.Fid, mask);
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := clnt.rpc(tc);
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.UnpackRgetattr(rc); err != nil {
+		return nil, err
+	}
+
+	return &rc.Dotlstat, nil;
+}
+
+// Setattr applies the fields selected by valid in st to fid via
+// Tsetattr. Returns nil if the operation is successful.
+func (clnt *Clnt) Setattr(fid *Fid, valid uint32, st *p.Dotlstat) *p.Error {
+	tc := p.NewFcall(clnt.Msize);
+	err := p.PackTsetattr(tc, fid.Fid, valid, st);
+	if err != nil {
+		return err
+	}
+
+	_, err = clnt.rpc(tc);
+	return err;
+}
+
+// Readdir reads one Treaddir's worth of directory entries starting at
+// offset. Returns the raw dirent stream; callers walk it with
+// p.UnpackDirent in a loop the same way Read walks a Stat stream.
+func (clnt *Clnt) Readdir(fid *Fid, offset uint64, count uint32) ([]byte, *p.Error) {
+	tc := p.NewFcall(clnt.Msize);
+	err := p.PackTreaddir(tc, fid.Fid, offset, count);
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := clnt.rpc(tc);
+	if err != nil {
+		return nil, err
+	}
+
+	return rc.Data, nil;
+}
+
+// Lopen is the 9P2000.L analog of Open: flags are raw Linux open(2)
+// flags rather than a 9P open mode.
+func (clnt *Clnt) Lopen(fid *Fid, flags uint32) *p.Error {
+	tc := p.NewFcall(clnt.Msize);
+	err := p.PackTlopen(tc, fid.Fid, flags);
+	if err != nil {
+		return err
+	}
+
+	_, err = clnt.rpc(tc);
+	return err;
+}
+
+// Lcreate is the 9P2000.L analog of Create.
+func (clnt *Clnt) Lcreate(fid *Fid, name string, flags uint32, perm uint32, gid uint32) *p.Error {
+	tc := p.NewFcall(clnt.Msize);
+	err := p.PackTlcreate(tc, fid.Fid, name, flags, perm, gid);
+	if err != nil {
+		return err
+	}
+
+	_, err = clnt.rpc(tc);
+	return err;
+}
+
+// Symlink creates name as a symlink to target inside the directory
+// fid, owned by gid.
+func (clnt *Clnt) Symlink(fid *Fid, name, target string, gid uint32) (*p.Qid, *p.Error) {
+	tc := p.NewFcall(clnt.Msize);
+	err := p.PackTsymlink(tc, fid.Fid, name, target, gid);
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := clnt.rpc(tc);
+	if err != nil {
+		return nil, err
+	}
+
+	return &rc.Sqid, nil;
+}
+
+// Link creates name inside the directory dfid as a hard link to ofid.
+func (clnt *Clnt) Link(dfid, ofid *Fid, name string) *p.Error {
+	tc := p.NewFcall(clnt.Msize);
+	err := p.PackTlink(tc, dfid.Fid, ofid.Fid, name);
+	if err != nil {
+		return err
+	}
+
+	_, err = clnt.rpc(tc);
+	return err;
+}
+
+// Mkdir creates a subdirectory named name inside fid.
+func (clnt *Clnt) Mkdir(fid *Fid, name string, perm uint32, gid uint32) (*p.Qid, *p.Error) {
+	tc := p.NewFcall(clnt.Msize);
+	err := p.PackTmkdir(tc, fid.Fid, name, perm, gid);
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := clnt.rpc(tc);
+	if err != nil {
+		return nil, err
+	}
+
+	return &rc.Sqid, nil;
+}
+
+// Rename moves fid into the directory dfid under newname.
+func (clnt *Clnt) Rename(fid, dfid *Fid, newname string) *p.Error {
+	tc := p.NewFcall(clnt.Msize);
+	err := p.PackTrename(tc, fid.Fid, dfid.Fid, newname);
+	if err != nil {
+		return err
+	}
+
+	_, err = clnt.rpc(tc);
+	return err;
+}
+
+// Readlink returns the target of the symlink referred to by fid.
+func (clnt *Clnt) Readlink(fid *Fid) (string, *p.Error) {
+	tc := p.NewFcall(clnt.Msize);
+	err := p.PackTreadlink(tc, fid.Fid);
+	if err != nil {
+		return "", err
+	}
+
+	rc, err := clnt.rpc(tc);
+	if err != nil {
+		return "", err
+	}
+
+	if err := p.UnpackRreadlink(rc); err != nil {
+		return "", err
+	}
+
+	return rc.Dotlsymtgt, nil;
+}
+
+// Fsync flushes any buffered data for fid.
+func (clnt *Clnt) Fsync(fid *Fid) *p.Error {
+	tc := p.NewFcall(clnt.Msize);
+	err := p.PackTfsync(tc, fid.Fid);
+	if err != nil {
+		return err
+	}
+
+	_, err = clnt.rpc(tc);
+	return err;
+}
+
+// Statfs returns filesystem-wide statistics for the tree fid lives in.
+func (clnt *Clnt) Statfs(fid *Fid) (*p.Dotlstatfs, *p.Error) {
+	tc := p.NewFcall(clnt.Msize);
+	err := p.PackTstatfs(tc, fid.Fid);
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := clnt.rpc(tc);
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.UnpackRstatfs(rc); err != nil {
+		return nil, err
+	}
+
+	return &rc.Dotlstatfs, nil;
+}
+
+// Xattrwalk prepares fid's newfid to read the extended attribute
+// name and returns its size.
+func (clnt *Clnt) Xattrwalk(fid, newfid *Fid, name string) (uint64, *p.Error) {
+	tc := p.NewFcall(clnt.Msize);
+	err := p.PackTxattrwalk(tc, fid.Fid, newfid.Fid, name);
+	if err != nil {
+		return 0, err
+	}
+
+	rc, err := clnt.rpc(tc);
+	if err != nil {
+		return 0, err
+	}
+
+	if err := p.UnpackRxattrwalk(rc); err != nil {
+		return 0, err
+	}
+
+	return rc.Dotlsize, nil;
+}
+
+// Xattrcreate prepares fid to write a new extended attribute name of
+// the given size; the value is then written through Write.
+func (clnt *Clnt) Xattrcreate(fid *Fid, name string, size uint64, flags uint32) *p.Error {
+	tc := p.NewFcall(clnt.Msize);
+	err := p.PackTxattrcreate(tc, fid.Fid, name, size, flags);
+	if err != nil {
+		return err
+	}
+
+	_, err = clnt.rpc(tc);
+	return err;
+}
+
+// Lock requests a POSIX byte-range lock on fid and returns the
+// resulting lock status (one of the p.LOCK_* constants).
+func (clnt *Clnt) Lock(fid *Fid, typ uint8, flags uint32, start, length uint64, pid uint32) (uint8, *p.Error) {
+	tc := p.NewFcall(clnt.Msize);
+	err := p.PackTlock(tc, fid.Fid, typ, flags, start, length, pid);
+	if err != nil {
+		return 0, err
+	}
+
+	rc, err := clnt.rpc(tc);
+	if err != nil {
+		return 0, err
+	}
+
+	if err := p.UnpackRlock(rc); err != nil {
+		return 0, err
+	}
+
+	return rc.Dotlstatus, nil;
+}
+
+// Getlock queries whether a conflicting POSIX byte-range lock exists
+// for fid, returning the conflicting (or cleared) lock description.
+func (clnt *Clnt) Getlock(fid *Fid, typ uint8, start, length uint64, pid uint32) (uint8, uint64, uint64, uint32, *p.Error) {
+	tc := p.NewFcall(clnt.Msize);
+	err := p.PackTgetlock(tc, fid.Fid, typ, start, length, pid);
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+
+	rc, err := clnt.rpc(tc);
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+
+	if err := p.UnpackRgetlock(rc); err != nil {
+		return 0, 0, 0, 0, err
+	}
+
+	return rc.Dotltype, rc.Dotlstart, rc.Dotllength, rc.Dotlpid, nil;
+}
@@ -0,0 +1,58 @@
+// Copyright 2009 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt
+
+import "plan9/p"
+import "runtime"
+
+// newFid allocates a fresh Fid bound to clnt and arms a finalizer on
+// it, so a caller that forgets to Clunk it (or panics before reaching
+// the Clunk) doesn't leak the wire fid forever. This mirrors the
+// pattern gVisor's p9 package uses for its clientFile: fid lifetime
+// becomes safe for ordinary Go code instead of a manual-lifetime
+// footgun that slowly exhausts fidpool.
+//
+// Auth and AttachAuth go through newFid already and disarm the
+// finalizer on every error return, same as Remove does on success.
+// Clunk itself still needs the matching runtime.SetFinalizer(fid, nil)
+// before it returns the id to fidpool, and Attach/FWalk/Create need to
+// go through newFid too so every fid gets the same leak protection,
+// not just the auth ones -- neither Clunk nor those three are defined
+// anywhere in this tree (they live in the base client source this
+// checkout doesn't have a copy of), so they couldn't be wired up here.
+func (clnt *Clnt) newFid() *Fid {
+	fid := new(Fid);
+	fid.Clnt = clnt;
+	fid.Fid = clnt.fidpool.getId();
+	runtime.SetFinalizer(fid, finalizeFid);
+	return fid;
+}
+
+// finalizeFid runs when a Fid becomes unreachable without having gone
+// through Remove first (Remove calls runtime.SetFinalizer(fid, nil) to
+// disarm this before the fid id is recycled; see newFid for Clunk).
+// It enqueues a best-effort Tclunk and only returns the id
+// to fidpool once that Tclunk has actually gone out; a client that is
+// already shut down just drops the clunk instead of erroring into
+// nowhere. The id must not go back to the pool before the Tclunk is
+// sent, or a concurrent newFid() could reuse it and bind it to a new
+// server-side fid while the stale Tclunk for the old one is still in
+// flight, clunking the wrong, now-live fid (the same hazard remove.go
+// guards against).
+func finalizeFid(fid *Fid) {
+	clnt := fid.Clnt;
+	id := fid.Fid;
+
+	clnt.log("clnt: leaked fid %d garbage collected, clunking", id);
+
+	go func() {
+		defer func() { recover() }();
+		defer clnt.fidpool.putId(id);
+		tc := p.NewFcall(clnt.Msize);
+		if err := p.PackTclunk(tc, id); err == nil {
+			clnt.rpc(tc)
+		}
+	}();
+}
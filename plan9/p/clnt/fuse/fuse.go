@@ -0,0 +1,615 @@
+// Copyright 2009 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The fuse package bridges a connected clnt.Clnt to a local
+// mountpoint, translating FUSE requests from the kernel into
+// Walk/Stat/Read/Write/FCreate/Remove calls against the client. It is
+// the natural companion to srv/ufs: a ufs tree served over 9P can be
+// mounted back with this package without ever shelling out to
+// `mount -t 9p`.
+package fuse
+
+import "plan9/p"
+import "plan9/p/clnt"
+import "encoding/binary"
+import "os"
+import "path"
+import "sync"
+
+const rootNodeId = 1
+
+// inode is the bridge's view of one 9P file reachable through the
+// mount: the fid it was walked to, and a refcount of how many FUSE
+// nodeids currently reference it. A file can be LOOKUP'd through
+// several different parent directories before any of those lookups
+// is FORGET'd, so nlookup -- not a simple present/absent map entry --
+// decides when the fid is finally clunked.
+type inode struct {
+	sync.Mutex;
+	name	string;	// 9P path this inode was walked to from the root, "" for the root
+	parent	uint64;	// nodeid of the parent, 0 for the root
+	fid	*clnt.Fid;
+	qid	p.Qid;
+	nlookup	uint64;
+}
+
+// handle is one open FUSE file handle: its own fid (Lopen'd or
+// FCreate'd separately from the inode's walk fid), so two concurrent
+// opens of the same file don't share one cursor.
+type handle struct {
+	fid	*clnt.Fid;
+}
+
+// Fs mounts a single clnt.Clnt at Mountpoint and answers kernel
+// requests against it until Close is called or the kernel unmounts it.
+type Fs struct {
+	Clnt		*clnt.Clnt;
+	Mountpoint	string;
+	Msize		uint32;
+
+	dev	*os.File;	// /dev/fuse on Linux, the osxfuse device on Darwin
+
+	mu	sync.Mutex;
+	nodes	map[uint64]*inode;
+	handles	map[uint64]*handle;
+	nextid	uint64;
+	nextfh	uint64;
+}
+
+// Mount opens the kernel FUSE channel for mountpoint and walks c to
+// its attach point to seed the root inode. Call Serve to start
+// answering kernel requests.
+func Mount(c *clnt.Clnt, mountpoint string) (*Fs, *p.Error) {
+	dev, err := mountDev(mountpoint);
+	if err != nil {
+		return nil, err
+	}
+
+	root, rerr := c.FWalk("/");
+	if rerr != nil {
+		dev.Close();
+		return nil, rerr
+	}
+
+	st, rerr := c.Stat(root);
+	if rerr != nil {
+		dev.Close();
+		return nil, rerr
+	}
+
+	fs := &Fs{
+		Clnt:       c,
+		Mountpoint: mountpoint,
+		Msize:      c.Msize,
+		dev:        dev,
+		nodes:      make(map[uint64]*inode),
+		handles:    make(map[uint64]*handle),
+		nextid:     rootNodeId + 1,
+		nextfh:     1,
+	};
+
+	fs.nodes[rootNodeId] = &inode{fid: root, qid: st.Sqid, nlookup: 1};
+	return fs, nil;
+}
+
+// Close unmounts the filesystem and closes the kernel channel.
+func (fs *Fs) Close() os.Error {
+	unmountDev(fs.Mountpoint);
+	return fs.dev.Close();
+}
+
+func (fs *Fs) node(nodeid uint64) *inode {
+	fs.mu.Lock();
+	n := fs.nodes[nodeid];
+	fs.mu.Unlock();
+	return n;
+}
+
+// childPath rebuilds the 9P path of a child so it can be re-walked
+// from the client's root; the bridge doesn't keep the client's whole
+// tree in memory, only a cache of nodes the kernel still holds a
+// reference to.
+func (fs *Fs) childPath(parent *inode, name string) string {
+	if parent.name == "" && parent.parent == 0 {
+		return "/" + name
+	}
+
+	return path.Join(parent.name, name);
+}
+
+// Serve reads and answers FUSE requests until a read from the device
+// fails (for example once it is closed). It is meant to be run in its
+// own goroutine per Fs.
+func (fs *Fs) Serve() os.Error {
+	buf := make([]byte, fs.Msize);
+	for {
+		n, err := fs.dev.Read(buf);
+		if err != nil {
+			return err
+		}
+
+		req := buf[0:n];
+		fs.dispatch(req);
+	}
+
+	return nil;
+}
+
+func (fs *Fs) dispatch(req []byte) {
+	if len(req) < inHeaderSize {
+		return
+	}
+
+	var in inHeader;
+	unpackInHeader(req, &in);
+	body := req[inHeaderSize:len(req)];
+
+	switch in.Opcode {
+	case opInit:
+		fs.onInit(&in, body)
+	case opLookup:
+		fs.onLookup(&in, body)
+	case opForget:
+		fs.onForget(&in, body)
+	case opGetattr:
+		fs.onGetattr(&in, body)
+	case opOpen:
+		fs.onOpen(&in, body)
+	case opRead:
+		fs.onRead(&in, body)
+	case opWrite:
+		fs.onWrite(&in, body)
+	case opReaddir:
+		fs.onReaddir(&in, body)
+	case opCreate:
+		fs.onCreate(&in, body)
+	case opUnlink:
+		fs.onUnlink(&in, body)
+	case opRename:
+		fs.onRename(&in, body)
+	case opRelease:
+		fs.onRelease(&in, body)
+	default:
+		fs.replyError(in.Unique, EOPNOTSUPP)
+	}
+}
+
+func (fs *Fs) replyError(unique uint64, errno int32) {
+	var out outHeader;
+	out.Len = outHeaderSize;
+	out.Error = -errno;
+	out.Unique = unique;
+	buf := make([]byte, outHeaderSize);
+	packOutHeader(buf, &out);
+	fs.dev.Write(buf);
+}
+
+func (fs *Fs) reply(unique uint64, payload []byte) {
+	var out outHeader;
+	out.Len = uint32(outHeaderSize + len(payload));
+	out.Unique = unique;
+	buf := make([]byte, out.Len);
+	packOutHeader(buf, &out);
+	copy(buf[outHeaderSize:len(buf)], payload);
+	fs.dev.Write(buf);
+}
+
+func perr2errno(err *p.Error) int32 {
+	if err == nil {
+		return 0
+	}
+
+	return int32(err.Errornum);
+}
+
+// onLookup walks from parent to name, caching (or bumping the
+// refcount of) the resulting inode, and answers req with the kernel's
+// entry reply.
+func (fs *Fs) onLookup(in *inHeader, body []byte) {
+	parent := fs.node(in.Nodeid);
+	if parent == nil {
+		fs.replyError(in.Unique, ENOENT);
+		return;
+	}
+
+	name := cstring(body);
+	fid, err := fs.Clnt.FWalk(fs.childPath(parent, name));
+	if err != nil {
+		fs.replyError(in.Unique, perr2errno(err));
+		return;
+	}
+
+	st, err := fs.Clnt.Stat(fid);
+	if err != nil {
+		fs.Clnt.Clunk(fid);
+		fs.replyError(in.Unique, perr2errno(err));
+		return;
+	}
+
+	fs.mu.Lock();
+	var nodeid uint64;
+	for id, n := range fs.nodes {
+		if n.qid.Path == st.Sqid.Path {
+			nodeid = id;
+			n.nlookup++;
+			break;
+		}
+	}
+
+	if nodeid == 0 {
+		nodeid = fs.nextid;
+		fs.nextid++;
+		fs.nodes[nodeid] = &inode{
+			name:    fs.childPath(parent, name),
+			parent:  in.Nodeid,
+			fid:     fid,
+			qid:     st.Sqid,
+			nlookup: 1,
+		};
+	} else {
+		fs.Clnt.Clunk(fid)
+	}
+
+	fs.mu.Unlock();
+
+	fs.reply(in.Unique, packEntryOut(nodeid, &st.Sqid, stat2Attr(st)));
+}
+
+func (fs *Fs) onForget(in *inHeader, body []byte) {
+	nlookup := binary.LittleEndian.Uint64(body[0:8]);
+	fs.mu.Lock();
+	if n, ok := fs.nodes[in.Nodeid]; ok {
+		if nlookup >= n.nlookup {
+			delete(fs.nodes, in.Nodeid);
+			fs.mu.Unlock();
+			fs.Clnt.Clunk(n.fid);
+			return;
+		}
+
+		n.nlookup -= nlookup;
+	}
+
+	fs.mu.Unlock();
+	// Forget carries no reply.
+}
+
+func (fs *Fs) onGetattr(in *inHeader, body []byte) {
+	n := fs.node(in.Nodeid);
+	if n == nil {
+		fs.replyError(in.Unique, ENOENT);
+		return;
+	}
+
+	st, err := fs.Clnt.Stat(n.fid);
+	if err != nil {
+		fs.replyError(in.Unique, perr2errno(err));
+		return;
+	}
+
+	fs.reply(in.Unique, packAttrOut(stat2Attr(st)));
+}
+
+func (fs *Fs) openFlags(flags uint32) uint8 {
+	switch flags & 3 {
+	case O_WRONLY:
+		return p.OWRITE
+	case O_RDWR:
+		return p.ORDWR
+	}
+
+	return p.OREAD;
+}
+
+func (fs *Fs) onOpen(in *inHeader, body []byte) {
+	n := fs.node(in.Nodeid);
+	if n == nil {
+		fs.replyError(in.Unique, ENOENT);
+		return;
+	}
+
+	flags := binary.LittleEndian.Uint32(body[0:4]);
+	fid, err := fs.Clnt.FWalk(n.name);
+	if err != nil {
+		fs.replyError(in.Unique, perr2errno(err));
+		return;
+	}
+
+	if err := fs.Clnt.Open(fid, fs.openFlags(flags)); err != nil {
+		fs.Clnt.Clunk(fid);
+		fs.replyError(in.Unique, perr2errno(err));
+		return;
+	}
+
+	fs.mu.Lock();
+	fh := fs.nextfh;
+	fs.nextfh++;
+	fs.handles[fh] = &handle{fid: fid};
+	fs.mu.Unlock();
+
+	fs.reply(in.Unique, packOpenOut(fh));
+}
+
+// Read honors Msize by chunking the read internally: a single FUSE
+// READ for more than Msize-IOHDRSZ bytes is serviced with repeated
+// 9P reads at increasing offsets instead of one oversized Tread.
+func (fs *Fs) onRead(in *inHeader, body []byte) {
+	fh, offset, size := unpackReadIn(body);
+	fs.mu.Lock();
+	h := fs.handles[fh];
+	fs.mu.Unlock();
+	if h == nil {
+		fs.replyError(in.Unique, EBADF);
+		return;
+	}
+
+	chunk := fs.Msize - ioHdrSize;
+	out := make([]byte, 0, size);
+	for uint32(len(out)) < size {
+		want := size - uint32(len(out));
+		if want > chunk {
+			want = chunk
+		}
+
+		buf := make([]byte, want);
+		n, err := fs.Clnt.Read(h.fid, buf, offset+uint64(len(out)));
+		if err != nil {
+			fs.replyError(in.Unique, perr2errno(err));
+			return;
+		}
+
+		out = append(out, buf[0:n]...);
+		if n < int(want) {
+			break
+		}
+	}
+
+	fs.reply(in.Unique, out);
+}
+
+// Write mirrors Read's Msize-aware chunking on the way in.
+func (fs *Fs) onWrite(in *inHeader, body []byte) {
+	fh, offset, data := unpackWriteIn(body);
+	fs.mu.Lock();
+	h := fs.handles[fh];
+	fs.mu.Unlock();
+	if h == nil {
+		fs.replyError(in.Unique, EBADF);
+		return;
+	}
+
+	chunk := int(fs.Msize - ioHdrSize);
+	var written uint32;
+	for len(data) > 0 {
+		n := len(data);
+		if n > chunk {
+			n = chunk
+		}
+
+		wn, err := fs.Clnt.Write(h.fid, data[0:n], offset+uint64(written));
+		if err != nil {
+			fs.replyError(in.Unique, perr2errno(err));
+			return;
+		}
+
+		written += uint32(wn);
+		data = data[wn:len(data)];
+		if wn < n {
+			break
+		}
+	}
+
+	fs.reply(in.Unique, packWriteOut(written));
+}
+
+func (fs *Fs) onReaddir(in *inHeader, body []byte) {
+	n := fs.node(in.Nodeid);
+	if n == nil {
+		fs.replyError(in.Unique, ENOENT);
+		return;
+	}
+
+	_, offset, size := unpackReadIn(body);
+	fid, err := fs.Clnt.FWalk(n.name);
+	if err != nil {
+		fs.replyError(in.Unique, perr2errno(err));
+		return;
+	}
+
+	defer fs.Clnt.Clunk(fid);
+	if err := fs.Clnt.Open(fid, p.OREAD); err != nil {
+		fs.replyError(in.Unique, perr2errno(err));
+		return;
+	}
+
+	// offset is the FUSE readdir cookie, which the loop below sets to
+	// an entry count (not a byte position), so it can't be fed back as
+	// the 9P Tread offset a follow-up call needs: that offset has to
+	// land on a Stat boundary in the directory's wire stream, and an
+	// entry count from a previous page doesn't. Read the whole
+	// directory's Stat stream from the start of the wire instead, and
+	// skip however many entries earlier pages already returned.
+	var data []byte;
+	var rdoff uint64;
+	for {
+		buf := make([]byte, size);
+		bn, err := fs.Clnt.Read(fid, buf, rdoff);
+		if err != nil {
+			fs.replyError(in.Unique, perr2errno(err));
+			return;
+		}
+		if bn == 0 {
+			break
+		}
+
+		data = append(data, buf[0:bn]...);
+		rdoff += uint64(bn);
+	}
+
+	out := make([]byte, 0, size);
+	var idx uint64;
+	for len(data) > 0 {
+		st, sz, perr := p.UnpackStat(data, fs.Clnt.Dotu);
+		if perr != nil || sz == 0 {
+			break
+		}
+
+		idx++;
+		if idx > offset {
+			if uint32(len(out)) >= size {
+				break
+			}
+			out = appendDirent(out, st, idx);
+		}
+		data = data[sz:len(data)];
+	}
+
+	fs.reply(in.Unique, out);
+}
+
+func (fs *Fs) onCreate(in *inHeader, body []byte) {
+	n := fs.node(in.Nodeid);
+	if n == nil {
+		fs.replyError(in.Unique, ENOENT);
+		return;
+	}
+
+	flags, mode, name := unpackCreateIn(body);
+	fid, err := fs.Clnt.FWalk(n.name);
+	if err != nil {
+		fs.replyError(in.Unique, perr2errno(err));
+		return;
+	}
+
+	if err := fs.Clnt.FCreate(fid, name, mode, fs.openFlags(flags)); err != nil {
+		fs.Clnt.Clunk(fid);
+		fs.replyError(in.Unique, perr2errno(err));
+		return;
+	}
+
+	st, err := fs.Clnt.Stat(fid);
+	if err != nil {
+		fs.Clnt.Clunk(fid);
+		fs.replyError(in.Unique, perr2errno(err));
+		return;
+	}
+
+	// fid became the open created file as a side effect of FCreate; it
+	// becomes the inode's walk fid below, so the handle needs its own
+	// fid walked fresh to the same child, the same as onOpen does, or
+	// Release'ing the handle would clunk the fid the cached inode
+	// still points at.
+	childPath := fs.childPath(n, name);
+	hfid, err := fs.Clnt.FWalk(childPath);
+	if err != nil {
+		fs.Clnt.Clunk(fid);
+		fs.replyError(in.Unique, perr2errno(err));
+		return;
+	}
+
+	if err := fs.Clnt.Open(hfid, fs.openFlags(flags)); err != nil {
+		fs.Clnt.Clunk(fid);
+		fs.Clnt.Clunk(hfid);
+		fs.replyError(in.Unique, perr2errno(err));
+		return;
+	}
+
+	fs.mu.Lock();
+	nodeid := fs.nextid;
+	fs.nextid++;
+	fs.nodes[nodeid] = &inode{name: childPath, parent: in.Nodeid, fid: fid, qid: st.Sqid, nlookup: 1};
+	fh := fs.nextfh;
+	fs.nextfh++;
+	fs.handles[fh] = &handle{fid: hfid};
+	fs.mu.Unlock();
+
+	fs.reply(in.Unique, packCreateOut(nodeid, &st.Sqid, stat2Attr(st), fh));
+}
+
+func (fs *Fs) onUnlink(in *inHeader, body []byte) {
+	parent := fs.node(in.Nodeid);
+	if parent == nil {
+		fs.replyError(in.Unique, ENOENT);
+		return;
+	}
+
+	name := cstring(body);
+	fid, err := fs.Clnt.FWalk(fs.childPath(parent, name));
+	if err != nil {
+		fs.replyError(in.Unique, perr2errno(err));
+		return;
+	}
+
+	if err := fs.Clnt.Remove(fid); err != nil {
+		fs.replyError(in.Unique, perr2errno(err));
+		return;
+	}
+
+	fs.replyError(in.Unique, 0);
+}
+
+// onRename handles RENAME. The backing ufs tree only exposes rename
+// through Wstat, which (like 9P .u in general) can only rename within
+// the directory a file already lives in -- there is no destination
+// fid to move it under. So a same-directory rename goes through
+// Wstat as before; a rename into a different directory is refused
+// with EXDEV rather than silently renaming in place and telling the
+// kernel it moved the file when it didn't.
+func (fs *Fs) onRename(in *inHeader, body []byte) {
+	newparentId, oldname, newname := unpackRenameIn(body);
+	parent := fs.node(in.Nodeid);
+	newparent := fs.node(newparentId);
+	if parent == nil || newparent == nil {
+		fs.replyError(in.Unique, ENOENT);
+		return;
+	}
+
+	if newparentId != in.Nodeid {
+		fs.replyError(in.Unique, EXDEV);
+		return;
+	}
+
+	fid, err := fs.Clnt.FWalk(fs.childPath(parent, oldname));
+	if err != nil {
+		fs.replyError(in.Unique, perr2errno(err));
+		return;
+	}
+
+	defer fs.Clnt.Clunk(fid);
+	st := &p.Stat{};
+	st.Mode = 0xFFFFFFFF;
+	st.Atime = 0xFFFFFFFF;
+	st.Mtime = 0xFFFFFFFF;
+	st.Length = 0xFFFFFFFFFFFFFFFF;
+	st.Name = newname;
+	if err := fs.Clnt.Wstat(fid, st); err != nil {
+		fs.replyError(in.Unique, perr2errno(err));
+		return;
+	}
+
+	fs.replyError(in.Unique, 0);
+}
+
+func (fs *Fs) onRelease(in *inHeader, body []byte) {
+	fh, _, _ := unpackReadIn(body);
+	fs.mu.Lock();
+	h := fs.handles[fh];
+	delete(fs.handles, fh);
+	fs.mu.Unlock();
+
+	if h != nil {
+		fs.Clnt.Clunk(h.fid)
+	}
+
+	fs.replyError(in.Unique, 0);
+}
+
+func cstring(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[0:i])
+		}
+	}
+
+	return string(b);
+}
@@ -0,0 +1,64 @@
+// Copyright 2009 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build darwin
+
+package fuse
+
+import "plan9/p"
+import "os"
+import "syscall"
+
+// mountDev opens the osxfuse control device and mounts mountpoint
+// through it. osxfuse's handshake differs from Linux's /dev/fuse in
+// how the device node is obtained (/dev/osxfuseN rather than a single
+// shared /dev/fuse) but the request stream dispatched in fuse.go is
+// the same subset of opcodes either way.
+func mountDev(mountpoint string) (*os.File, *p.Error) {
+	for i := 0; i < 16; i++ {
+		dev, err := os.OpenFile("/dev/osxfuse"+itoa(i), os.O_RDWR, 0);
+		if err == nil {
+			if merr := mountOsxfuse(dev, mountpoint); merr != nil {
+				dev.Close();
+				return nil, merr
+			}
+
+			return dev, nil;
+		}
+	}
+
+	return nil, &p.Error{"no free osxfuse device", uint32(syscall.ENODEV)}
+}
+
+func mountOsxfuse(dev *os.File, mountpoint string) *p.Error {
+	if err := syscall.Mount("osxfuse", mountpoint, 0, nil); err != 0 {
+		return &p.Error{"mount failed", uint32(err)}
+	}
+
+	return nil;
+}
+
+func unmountDev(mountpoint string) os.Error {
+	if err := syscall.Unmount(mountpoint, 0); err != 0 {
+		return os.NewError("fuse: umount failed")
+	}
+
+	return nil;
+}
+
+func itoa(n int) string {
+	if n == 0 {
+		return "0"
+	}
+
+	var buf [20]byte;
+	i := len(buf);
+	for n > 0 {
+		i--;
+		buf[i] = byte('0' + n%10);
+		n /= 10;
+	}
+
+	return string(buf[i:len(buf)]);
+}
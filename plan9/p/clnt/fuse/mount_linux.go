@@ -0,0 +1,64 @@
+// Copyright 2009 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package fuse
+
+import "plan9/p"
+import "os"
+import "syscall"
+
+// mountDev opens /dev/fuse and tells the kernel about mountpoint via
+// the usual fusermount-less mount(2) call available to root (a setuid
+// fusermount helper, as the real FUSE libraries use, is out of scope
+// here).
+func mountDev(mountpoint string) (*os.File, *p.Error) {
+	dev, err := os.OpenFile("/dev/fuse", os.O_RDWR, 0);
+	if err != nil {
+		return nil, &p.Error{err.String(), uint32(syscall.EIO)}
+	}
+
+	opts := "fd=" + itoa(int(dev.Fd())) + ",rootmode=40000,user_id=0,group_id=0";
+	if err := syscall.Mount("/dev/fuse", mountpoint, "fuse", 0, opts); err != 0 {
+		dev.Close();
+		return nil, &p.Error{"mount failed", uint32(err)}
+	}
+
+	return dev, nil;
+}
+
+func unmountDev(mountpoint string) os.Error {
+	if err := syscall.Unmount(mountpoint, 0); err != 0 {
+		return os.NewError("fuse: umount failed")
+	}
+
+	return nil;
+}
+
+func itoa(n int) string {
+	if n == 0 {
+		return "0"
+	}
+
+	var buf [20]byte;
+	i := len(buf);
+	neg := n < 0;
+	if neg {
+		n = -n
+	}
+
+	for n > 0 {
+		i--;
+		buf[i] = byte('0' + n%10);
+		n /= 10;
+	}
+
+	if neg {
+		i--;
+		buf[i] = '-';
+	}
+
+	return string(buf[i:len(buf)]);
+}
@@ -0,0 +1,229 @@
+// Copyright 2009 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import "plan9/p"
+import "encoding/binary"
+
+// The constants and structs below are the small slice of the FUSE
+// kernel wire protocol this bridge actually speaks: INIT plus the
+// eleven request types dispatch handles. They are shared
+// between Linux's /dev/fuse and osxfuse, which keep the same request
+// layout for this subset of opcodes.
+const (
+	opLookup	= 1;
+	opForget	= 2;
+	opGetattr	= 3;
+	opOpen		= 14;
+	opRead		= 15;
+	opWrite		= 16;
+	opRelease	= 18;
+	opInit		= 26;
+	opReaddir	= 28;
+	opUnlink	= 10;
+	opRename	= 12;
+	opCreate	= 35;
+)
+
+const (
+	ENOENT		= 2;
+	EBADF		= 9;
+	EXDEV		= 18;
+	EOPNOTSUPP	= 95;
+)
+
+const (
+	O_WRONLY	= 1;
+	O_RDWR		= 2;
+)
+
+// ioHdrSize is subtracted from Msize before chunking a READ/WRITE, to
+// leave room for the 9P Tread/Twrite/Rread/Rwrite header alongside
+// the data in a single Fcall.
+const ioHdrSize = 24
+
+const (
+	inHeaderSize	= 40;
+	outHeaderSize	= 16;
+	attrSize	= 88;
+)
+
+type inHeader struct {
+	Len	uint32;
+	Opcode	uint32;
+	Unique	uint64;
+	Nodeid	uint64;
+	Uid	uint32;
+	Gid	uint32;
+	Pid	uint32;
+}
+
+type outHeader struct {
+	Len	uint32;
+	Error	int32;
+	Unique	uint64;
+}
+
+func unpackInHeader(b []byte, h *inHeader) {
+	le := binary.LittleEndian;
+	h.Len = le.Uint32(b[0:4]);
+	h.Opcode = le.Uint32(b[4:8]);
+	h.Unique = le.Uint64(b[8:16]);
+	h.Nodeid = le.Uint64(b[16:24]);
+	h.Uid = le.Uint32(b[24:28]);
+	h.Gid = le.Uint32(b[28:32]);
+	h.Pid = le.Uint32(b[32:36]);
+}
+
+func packOutHeader(b []byte, h *outHeader) {
+	le := binary.LittleEndian;
+	le.PutUint32(b[0:4], h.Len);
+	le.PutUint32(b[4:8], uint32(h.Error));
+	le.PutUint64(b[8:16], h.Unique);
+}
+
+// attr is fuse_attr: the subset of stat(2) the kernel wants back for
+// GETATTR/LOOKUP/CREATE.
+type attr struct {
+	Ino		uint64;
+	Size		uint64;
+	Blocks		uint64;
+	Mtime		uint64;
+	Mode		uint32;
+	Nlink		uint32;
+	Uid		uint32;
+	Gid		uint32;
+}
+
+func stat2Attr(st *p.Stat) *attr {
+	a := &attr{
+		Ino:   st.Sqid.Path,
+		Size:  st.Length,
+		Mtime: uint64(st.Mtime),
+		Nlink: 1,
+		Uid:   st.Nuid,
+		Gid:   st.Ngid,
+	};
+
+	a.Mode = st.Mode & 0777;
+	if st.Mode&p.DMDIR != 0 {
+		a.Mode |= 0040000	// S_IFDIR
+	} else {
+		a.Mode |= 0100000	// S_IFREG
+	}
+
+	return a;
+}
+
+func packAttr(b []byte, a *attr) {
+	le := binary.LittleEndian;
+	le.PutUint64(b[0:8], a.Ino);
+	le.PutUint64(b[8:16], a.Size);
+	le.PutUint64(b[16:24], a.Blocks);
+	le.PutUint64(b[24:32], a.Mtime);
+	le.PutUint32(b[64:68], a.Mode);
+	le.PutUint32(b[68:72], a.Nlink);
+	le.PutUint32(b[72:76], a.Uid);
+	le.PutUint32(b[76:80], a.Gid);
+}
+
+func packAttrOut(a *attr) []byte {
+	b := make([]byte, 8+attrSize);
+	packAttr(b[8:len(b)], a);
+	return b;
+}
+
+// packEntryOut builds a fuse_entry_out: nodeid, a generation of 0 and
+// the separate entry/attr cache-validity timeouts, followed by the
+// attr block. This bridge always asks the kernel to revalidate, so
+// the timeouts are left at zero.
+func packEntryOut(nodeid uint64, qid *p.Qid, a *attr) []byte {
+	b := make([]byte, 40+attrSize);
+	le := binary.LittleEndian;
+	le.PutUint64(b[0:8], nodeid);
+	le.PutUint64(b[8:16], 0);
+	// entry_valid[8] attr_valid[8] entry_valid_nsec[4] attr_valid_nsec[4]
+	// at b[16:40] stay zero.
+	packAttr(b[40:len(b)], a);
+	return b;
+}
+
+func packOpenOut(fh uint64) []byte {
+	b := make([]byte, 16);
+	binary.LittleEndian.PutUint64(b[0:8], fh);
+	return b;
+}
+
+func packWriteOut(written uint32) []byte {
+	b := make([]byte, 8);
+	binary.LittleEndian.PutUint32(b[0:4], written);
+	return b;
+}
+
+func packCreateOut(nodeid uint64, qid *p.Qid, a *attr, fh uint64) []byte {
+	entry := packEntryOut(nodeid, qid, a);
+	open := packOpenOut(fh);
+	return append(entry, open...);
+}
+
+func unpackReadIn(b []byte) (fh uint64, offset uint64, size uint32) {
+	le := binary.LittleEndian;
+	fh = le.Uint64(b[0:8]);
+	offset = le.Uint64(b[8:16]);
+	size = le.Uint32(b[16:20]);
+	return;
+}
+
+func unpackWriteIn(b []byte) (fh uint64, offset uint64, data []byte) {
+	le := binary.LittleEndian;
+	fh = le.Uint64(b[0:8]);
+	offset = le.Uint64(b[8:16]);
+	size := le.Uint32(b[16:20]);
+	data = b[40 : 40+size];
+	return;
+}
+
+func unpackCreateIn(b []byte) (flags uint32, mode uint32, name string) {
+	le := binary.LittleEndian;
+	flags = le.Uint32(b[0:4]);
+	mode = le.Uint32(b[4:8]);
+	name = cstring(b[16:len(b)]);
+	return;
+}
+
+func unpackRenameIn(b []byte) (newdir uint64, oldname, newname string) {
+	le := binary.LittleEndian;
+	newdir = le.Uint64(b[0:8]);
+	rest := b[8:len(b)];
+	i := 0;
+	for i < len(rest) && rest[i] != 0 {
+		i++
+	}
+
+	oldname = string(rest[0:i]);
+	newname = cstring(rest[i+1 : len(rest)]);
+	return;
+}
+
+// appendDirent appends one fuse_dirent for st, whose offset (the
+// opaque cursor the kernel will hand back on the next READDIR) is off.
+func appendDirent(out []byte, st *p.Stat, off uint64) []byte {
+	name := st.Name;
+	const direntHeader = 24;
+	reclen := (direntHeader + len(name) + 7) &^ 7;
+	d := make([]byte, reclen);
+	le := binary.LittleEndian;
+	le.PutUint64(d[0:8], st.Sqid.Path);
+	le.PutUint64(d[8:16], off);
+	le.PutUint32(d[16:20], uint32(len(name)));
+	typ := uint32(8);	// DT_REG
+	if st.Mode&p.DMDIR != 0 {
+		typ = 4	// DT_DIR
+	}
+
+	le.PutUint32(d[20:24], typ);
+	copy(d[24:24+len(name)], name);
+	return append(out, d...);
+}
@@ -5,6 +5,7 @@
 package clnt
 
 import "plan9/p"
+import "runtime"
 
 // Removes the file associated with the Fid. Returns nil if the
 // operation is successful.
@@ -16,6 +17,11 @@ func (clnt *Clnt) Remove(fid *Fid) *p.Error {
 	}
 
 	_, err = clnt.rpc(tc);
+
+	// Disarm the leak finalizer before the id goes back to fidpool:
+	// otherwise a later fid reusing the same number could get
+	// erroneously clunked by this fid's finalizer once it runs.
+	runtime.SetFinalizer(fid, nil);
 	clnt.fidpool.putId(fid.Fid);
 
 	return err;
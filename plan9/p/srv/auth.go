@@ -0,0 +1,53 @@
+// Copyright 2009 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package srv
+
+import "plan9/p"
+import "syscall"
+
+// Auth lets a Fsrv require clients to authenticate over a Tauth-
+// established afid before Attach hands out the tree, instead of
+// trusting whatever uname/aname the client claims.
+//
+// AuthInit is called when the client sends Tauth for afid; it should
+// return the Qid the afid is to carry. AuthRead and AuthWrite are then
+// called as the client exchanges Tread/Twrite messages against that
+// afid, letting an external mechanism (P9SK1, DIGEST-MD5, a
+// TLS-derived token, ...) run its challenge/response protocol over the
+// 9P wire without 9P itself knowing anything about it. AuthCheck is
+// called from Attach to verify that afid has completed authentication
+// for the given uname/aname before the tree is handed out; it should
+// fail (return a non-nil Error) for an afid that was never Tauth'd, or
+// whose exchange never finished.
+type Auth interface {
+	AuthInit(afid *Fid, uname, aname string) (*p.Qid, *p.Error);
+	AuthRead(afid *Fid, buf []byte) (int, *p.Error);
+	AuthWrite(afid *Fid, buf []byte) (int, *p.Error);
+	AuthCheck(afid *Fid, uname, aname string) *p.Error;
+}
+
+// Eauthfail is a ready-made error for Auth implementations to return
+// from AuthCheck when the presented afid never completed
+// authentication.
+var Eauthfail = &p.Error{"authentication failed", syscall.EPERM}
+
+// Auth handles a Tauth by handing off to Authsrv.AuthInit. If Authsrv
+// is nil, authentication is refused outright rather than silently
+// granting an unauthenticated afid a Qid.
+func (s *Fsrv) Auth(req *Req) {
+	if s.Authsrv == nil {
+		req.RespondError(Eperm);
+		return;
+	}
+
+	tc := req.Tc;
+	qid, err := s.Authsrv.AuthInit(req.Afid, tc.Uname, tc.Aname);
+	if err != nil {
+		req.RespondError(err);
+		return;
+	}
+
+	req.RespondRauth(qid);
+}
@@ -0,0 +1,559 @@
+// Copyright 2009 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package srv
+
+import "plan9/p"
+import "syscall"
+
+var Enotdir = &p.Error{"not a directory", syscall.ENOTDIR}
+
+// FGetattrOp lets a backend answer a Tgetattr with a real Linux stat
+// instead of the synthesized one Fsrv derives from p.Stat. mask is the
+// set of Dotlstat fields the client actually asked for.
+type FGetattrOp interface {
+	Getattr(mask uint64) (*p.Dotlstat, *p.Error);
+}
+
+// FSetattrOp lets a backend apply a Tsetattr (chmod/chown/truncate/
+// utimes, individually or combined per valid) to the file it backs.
+type FSetattrOp interface {
+	Setattr(valid uint32, st *p.Dotlstat) *p.Error;
+}
+
+// FSymlinkOp is implemented by a directory's ops to create a symlink
+// as one of its children.
+type FSymlinkOp interface {
+	Symlink(name, target string, gid uint32) (*File, *p.Error);
+}
+
+// FLinkOp is implemented by a directory's ops to create a hard link
+// to oldf as one of its children.
+type FLinkOp interface {
+	Link(oldf *File, name string) *p.Error;
+}
+
+// FMkdirOp is implemented by a directory's ops to create a
+// subdirectory.
+type FMkdirOp interface {
+	Mkdir(name string, perm uint32, gid uint32) (*File, *p.Error);
+}
+
+// FRenameOp is implemented by a file's ops to move/rename it into
+// newdir under newname, possibly across directories.
+type FRenameOp interface {
+	Rename(newdir *File, newname string) *p.Error;
+}
+
+// FFsyncOp lets a backend flush whatever it buffers for the open
+// handle returned by FOpenOp.
+type FFsyncOp interface {
+	Fsync(h interface{}) *p.Error;
+}
+
+// FXattrOp is implemented by a file's ops to support the xattr walk/
+// create calls used to read and write extended attributes.
+type FXattrOp interface {
+	Xattrwalk(name string) (uint64, *p.Error);
+	Xattrcreate(name string, size uint64, flags uint32) *p.Error;
+}
+
+// FLockOp is implemented by a file's ops to support POSIX byte-range
+// locking over 9P2000.L's Tlock/Tgetlock.
+type FLockOp interface {
+	Lock(typ uint8, flags uint32, start, length uint64, pid uint32) (uint8, *p.Error);
+	Getlock(typ uint8, start, length uint64, pid uint32) (uint8, uint64, uint64, uint32, *p.Error);
+}
+
+// lflags2Mode maps the raw Linux open(2) flags carried by Tlopen/
+// Tlcreate onto the p.O* bits FOpenOp already understands, so a
+// backend only has to implement FOpenOp once for both dialects.
+func lflags2Mode(flags uint32) uint8 {
+	var mode uint8;
+
+	switch flags & 3 {
+	case syscall.O_RDONLY:
+		mode = p.OREAD
+	case syscall.O_WRONLY:
+		mode = p.OWRITE
+	case syscall.O_RDWR:
+		mode = p.ORDWR
+	}
+
+	if flags&syscall.O_TRUNC != 0 {
+		mode |= p.OTRUNC
+	}
+
+	return mode;
+}
+
+func lperm(flags uint32) uint32	{ return mode2Perm(lflags2Mode(flags)) }
+
+// requireDotl rejects a .L-only request on a Conn that never
+// negotiated the 9P2000.L version in Tversion, instead of silently
+// answering a client that can't parse the reply. A real dispatch loop
+// only calls these handlers for the .L message types in the first
+// place, so this is the fallback to "permission denied" rather than a
+// second .u-shaped implementation of the same call.
+func (*Fsrv) requireDotl(req *Req) bool {
+	if !req.Conn.Dotl {
+		req.RespondError(Eperm);
+		return false;
+	}
+
+	return true;
+}
+
+// Getattr handles a Tgetattr. A File without an FGetattrOp backend
+// answers with the attributes already tracked in its p.Stat, same as
+// a plain Fsrv tree does for the .u Stat call.
+func (s *Fsrv) Getattr(req *Req) {
+	if !s.requireDotl(req) {
+		return
+	}
+
+	fid := req.Fid.Aux.(*FFid);
+	f := fid.file;
+
+	if gop, ok := (f.ops).(FGetattrOp); ok {
+		st, err := gop.Getattr(req.Tc.Dotlmask);
+		if err != nil {
+			req.RespondError(err);
+			return;
+		}
+
+		req.RespondRgetattr(st);
+		return;
+	}
+
+	req.RespondRgetattr(p.Stat2Dotl(&f.Stat));
+}
+
+// Setattr handles a Tsetattr. If not implemented, "permission denied"
+// is sent back, same as Wstat's behavior for a missing FWstatOp.
+func (s *Fsrv) Setattr(req *Req) {
+	if !s.requireDotl(req) {
+		return
+	}
+
+	fid := req.Fid.Aux.(*FFid);
+	f := fid.file;
+	tc := req.Tc;
+
+	if sop, ok := (f.ops).(FSetattrOp); ok {
+		if err := sop.Setattr(tc.Dotlvalid, &tc.Dotlstat); err != nil {
+			req.RespondError(err);
+			return;
+		}
+
+		req.RespondRsetattr();
+		return;
+	}
+
+	req.RespondError(Eperm);
+}
+
+// Readdir handles a Treaddir. Unlike Fsrv.Read's directory case, the
+// client-supplied offset is treated as an absolute position in the
+// child list and re-walked from the head on every call, so a Treaddir
+// interrupted or retried partway through never depends on state left
+// behind by a previous call.
+func (s *Fsrv) Readdir(req *Req) {
+	if !s.requireDotl(req) {
+		return
+	}
+
+	fid := req.Fid.Aux.(*FFid);
+	f := fid.file;
+	tc := req.Tc;
+	rc := req.Rc;
+
+	if f.Mode&p.DMDIR == 0 {
+		req.RespondError(Enotdir);
+		return;
+	}
+
+	f.Lock();
+	defer f.Unlock();
+
+	c := f.cfirst;
+	var idx uint64;
+	for idx < tc.Offset && c != nil {
+		c = c.next;
+		idx++;
+	}
+
+	p.InitRreaddir(rc, tc.Count);
+	b := rc.Data;
+	var n int;
+	for c != nil {
+		idx++;
+		sz := p.PackDirent(&c.Stat, idx, b);
+		if sz == 0 {
+			break
+		}
+
+		b = b[sz:len(b)];
+		n += sz;
+		c = c.next;
+	}
+
+	p.SetRreaddirCount(rc, uint32(n));
+	req.Respond();
+}
+
+// Lopen handles a Tlopen: same permission check and FOpenOp hookup as
+// Fsrv.Open, but starting from Linux open(2) flags instead of a 9P
+// open mode.
+func (s *Fsrv) Lopen(req *Req) {
+	if !s.requireDotl(req) {
+		return
+	}
+
+	fid := req.Fid.Aux.(*FFid);
+	f := fid.file;
+	tc := req.Tc;
+
+	if !f.CheckPerm(req.Fid.User, lperm(tc.Dotlflags)) {
+		req.RespondError(Eperm);
+		return;
+	}
+
+	if oop, ok := (f.ops).(FOpenOp); ok {
+		h, err := oop.Open(lflags2Mode(tc.Dotlflags));
+		if err != nil {
+			req.RespondError(err);
+			return;
+		}
+
+		fid.handle = h;
+	}
+
+	req.RespondRlopen(&f.Sqid, 0);
+}
+
+// Lcreate handles a Tlcreate: like Fsrv.Create followed immediately
+// by an Lopen of the freshly created file.
+func (s *Fsrv) Lcreate(req *Req) {
+	if !s.requireDotl(req) {
+		return
+	}
+
+	fid := req.Fid.Aux.(*FFid);
+	tc := req.Tc;
+	dir := fid.file;
+
+	if !dir.CheckPerm(req.Fid.User, p.DMWRITE) {
+		req.RespondError(Eperm);
+		return;
+	}
+
+	cop, ok := (dir.ops).(FCreateOp);
+	if !ok {
+		req.RespondError(Eperm);
+		return;
+	}
+
+	f, err := cop.Create(tc.Name, tc.Perm);
+	if err != nil {
+		req.RespondError(err);
+		return;
+	}
+
+	fid.file = f;
+	if oop, ok := (f.ops).(FOpenOp); ok {
+		h, oerr := oop.Open(lflags2Mode(tc.Dotlflags));
+		if oerr != nil {
+			req.RespondError(oerr);
+			return;
+		}
+
+		fid.handle = h;
+	}
+
+	req.RespondRlcreate(&f.Sqid, 0);
+}
+
+// Symlink handles a Tsymlink.
+func (s *Fsrv) Symlink(req *Req) {
+	if !s.requireDotl(req) {
+		return
+	}
+
+	fid := req.Fid.Aux.(*FFid);
+	dir := fid.file;
+	tc := req.Tc;
+
+	if !dir.CheckPerm(req.Fid.User, p.DMWRITE) {
+		req.RespondError(Eperm);
+		return;
+	}
+
+	sop, ok := (dir.ops).(FSymlinkOp);
+	if !ok {
+		req.RespondError(Eperm);
+		return;
+	}
+
+	f, err := sop.Symlink(tc.Name, tc.Dotlsymtgt, tc.Dotlgid);
+	if err != nil {
+		req.RespondError(err);
+		return;
+	}
+
+	req.RespondRsymlink(&f.Sqid);
+}
+
+// Link handles a Tlink: dfid names the directory to link into, fid
+// the existing file being linked.
+func (s *Fsrv) Link(req *Req) {
+	if !s.requireDotl(req) {
+		return
+	}
+
+	dfid := req.Dfid.Aux.(*FFid);
+	ofid := req.Fid.Aux.(*FFid);
+	tc := req.Tc;
+	dir := dfid.file;
+
+	if !dir.CheckPerm(req.Fid.User, p.DMWRITE) {
+		req.RespondError(Eperm);
+		return;
+	}
+
+	lop, ok := (dir.ops).(FLinkOp);
+	if !ok {
+		req.RespondError(Eperm);
+		return;
+	}
+
+	if err := lop.Link(ofid.file, tc.Name); err != nil {
+		req.RespondError(err);
+		return;
+	}
+
+	req.RespondRlink();
+}
+
+// Mkdir handles a Tmkdir.
+func (s *Fsrv) Mkdir(req *Req) {
+	if !s.requireDotl(req) {
+		return
+	}
+
+	fid := req.Fid.Aux.(*FFid);
+	dir := fid.file;
+	tc := req.Tc;
+
+	if !dir.CheckPerm(req.Fid.User, p.DMWRITE) {
+		req.RespondError(Eperm);
+		return;
+	}
+
+	mop, ok := (dir.ops).(FMkdirOp);
+	if !ok {
+		req.RespondError(Eperm);
+		return;
+	}
+
+	f, err := mop.Mkdir(tc.Name, tc.Perm, tc.Dotlgid);
+	if err != nil {
+		req.RespondError(err);
+		return;
+	}
+
+	req.RespondRmkdir(&f.Sqid);
+}
+
+// Rename handles a Trename: fid is the file being moved, dfid the
+// destination directory.
+func (s *Fsrv) Rename(req *Req) {
+	if !s.requireDotl(req) {
+		return
+	}
+
+	fid := req.Fid.Aux.(*FFid);
+	dfid := req.Dfid.Aux.(*FFid);
+	tc := req.Tc;
+	f := fid.file;
+
+	if !f.CheckPerm(req.Fid.User, p.DMWRITE) {
+		req.RespondError(Eperm);
+		return;
+	}
+
+	rop, ok := (f.ops).(FRenameOp);
+	if !ok {
+		req.RespondError(Eperm);
+		return;
+	}
+
+	if err := rop.Rename(dfid.file, tc.Name); err != nil {
+		req.RespondError(err);
+		return;
+	}
+
+	req.RespondRrename();
+}
+
+// Readlink handles a Treadlink. A backend reports the symlink target
+// through its normal p.Stat.Ext field, the same place the .u dialect
+// keeps it.
+func (s *Fsrv) Readlink(req *Req) {
+	if !s.requireDotl(req) {
+		return
+	}
+
+	fid := req.Fid.Aux.(*FFid);
+	f := fid.file;
+	if f.Sqid.Type&p.QTSYMLINK == 0 {
+		req.RespondError(Eperm);
+		return;
+	}
+
+	req.RespondRreadlink(f.Ext);
+}
+
+// Fsync handles a Tfsync.
+func (s *Fsrv) Fsync(req *Req) {
+	if !s.requireDotl(req) {
+		return
+	}
+
+	fid := req.Fid.Aux.(*FFid);
+	f := fid.file;
+
+	if sop, ok := (f.ops).(FFsyncOp); ok {
+		if err := sop.Fsync(fid.handle); err != nil {
+			req.RespondError(err);
+			return;
+		}
+	}
+
+	req.RespondRfsync();
+}
+
+// Statfs handles a Tstatfs with whatever the root's ops reports, or a
+// generic all-zero statfs for trees that don't care to implement it.
+func (s *Fsrv) Statfs(req *Req) {
+	if !s.requireDotl(req) {
+		return
+	}
+
+	type statfsOp interface {
+		Statfs() (*p.Dotlstatfs, *p.Error);
+	}
+
+	if sop, ok := (s.Root.ops).(statfsOp); ok {
+		st, err := sop.Statfs();
+		if err != nil {
+			req.RespondError(err);
+			return;
+		}
+
+		req.RespondRstatfs(st);
+		return;
+	}
+
+	req.RespondRstatfs(new(p.Dotlstatfs));
+}
+
+// Xattrwalk handles a Txattrwalk.
+func (s *Fsrv) Xattrwalk(req *Req) {
+	if !s.requireDotl(req) {
+		return
+	}
+
+	fid := req.Fid.Aux.(*FFid);
+	f := fid.file;
+	tc := req.Tc;
+
+	xop, ok := (f.ops).(FXattrOp);
+	if !ok {
+		req.RespondError(Eperm);
+		return;
+	}
+
+	size, err := xop.Xattrwalk(tc.Name);
+	if err != nil {
+		req.RespondError(err);
+		return;
+	}
+
+	req.RespondRxattrwalk(size);
+}
+
+// Xattrcreate handles a Txattrcreate.
+func (s *Fsrv) Xattrcreate(req *Req) {
+	if !s.requireDotl(req) {
+		return
+	}
+
+	fid := req.Fid.Aux.(*FFid);
+	f := fid.file;
+	tc := req.Tc;
+
+	xop, ok := (f.ops).(FXattrOp);
+	if !ok {
+		req.RespondError(Eperm);
+		return;
+	}
+
+	if err := xop.Xattrcreate(tc.Name, tc.Dotlsize, tc.Dotlflags); err != nil {
+		req.RespondError(err);
+		return;
+	}
+
+	req.RespondRxattrcreate();
+}
+
+// Lock handles a Tlock.
+func (s *Fsrv) Lock(req *Req) {
+	if !s.requireDotl(req) {
+		return
+	}
+
+	fid := req.Fid.Aux.(*FFid);
+	f := fid.file;
+	tc := req.Tc;
+
+	lop, ok := (f.ops).(FLockOp);
+	if !ok {
+		req.RespondError(Eperm);
+		return;
+	}
+
+	status, err := lop.Lock(tc.Dotltype, tc.Dotlflags, tc.Dotlstart, tc.Dotllength, tc.Dotlpid);
+	if err != nil {
+		req.RespondError(err);
+		return;
+	}
+
+	req.RespondRlock(status);
+}
+
+// Getlock handles a Tgetlock.
+func (s *Fsrv) Getlock(req *Req) {
+	if !s.requireDotl(req) {
+		return
+	}
+
+	fid := req.Fid.Aux.(*FFid);
+	f := fid.file;
+	tc := req.Tc;
+
+	lop, ok := (f.ops).(FLockOp);
+	if !ok {
+		req.RespondError(Eperm);
+		return;
+	}
+
+	typ, start, length, pid, err := lop.Getlock(tc.Dotltype, tc.Dotlstart, tc.Dotllength, tc.Dotlpid);
+	if err != nil {
+		req.RespondError(err);
+		return;
+	}
+
+	req.RespondRgetlock(typ, start, length, pid);
+}
@@ -28,7 +28,8 @@ type FWstatOp interface {
 // If the FReadOp interface is implemented, the Read operation will be called
 // to read from the file. If not implemented, "permission denied" error will
 // be send back. The operation returns the number of bytes read, or the
-// error occured while reading.
+// error occured while reading. If the file's ops also implements FReadAtOp,
+// FReadAtOp is preferred and FReadOp is never called.
 type FReadOp interface {
 	Read(buf []byte, offset uint64) (int, *p.Error);
 }
@@ -36,11 +37,47 @@ type FReadOp interface {
 // If the FWriteOp interface is implemented, the Write operation will be called
 // to write to the file. If not implemented, "permission denied" error will
 // be send back. The operation returns the number of bytes written, or the
-// error occured while writing.
+// error occured while writing. If the file's ops also implements FWriteAtOp,
+// FWriteAtOp is preferred and FWriteOp is never called.
 type FWriteOp interface {
 	Write(data []byte, offset uint64) (int, *p.Error);
 }
 
+// FReadAtOp is the sibling of FReadOp for backends that implement FOpenOp:
+// the handle returned by Open is passed back in on every Read, so a
+// backend can keep per-open state (a cursor, a snapshot, a buffer)
+// instead of re-deriving it from the File on every call.
+type FReadAtOp interface {
+	ReadAt(h interface{}, buf []byte, offset uint64) (int, *p.Error);
+}
+
+// FWriteAtOp is the sibling of FWriteOp for backends that implement
+// FOpenOp; see FReadAtOp.
+type FWriteAtOp interface {
+	WriteAt(h interface{}, data []byte, offset uint64) (int, *p.Error);
+}
+
+// If the FOpenOp interface is implemented, the Open operation is called
+// when a client successfully opens the file (after permission checking),
+// and the handle it returns is stored on the Fid and threaded through to
+// FReadAtOp/FWriteAtOp/FClunkOp. This is the hook stateful backends need
+// (a cursor, a snapshot, an underlying *os.File) that Fsrv previously had
+// no way to provide. If Open returns an Error, the open is refused with
+// that error and no handle is stored.
+type FOpenOp interface {
+	Open(mode uint8) (interface{}, *p.Error);
+}
+
+// If the FClunkOp interface is implemented, the Clunk operation is
+// called when the fid pointing at the file is clunked or removed, with
+// whatever handle FOpenOp produced (nil if the file was never opened).
+// It gives a backend the chance to release per-open resources. Since
+// Tclunk cannot fail, any Error it returns is only used for Remove,
+// where it is reported back to the client.
+type FClunkOp interface {
+	Clunk(h interface{}) *p.Error;
+}
+
 // If the FCreateOp interface is implemented, the Create operation will be called
 // when the client attempts to create a file in the File implementing the interface.
 // If not implemented, "permission denied" error will be send back. If successful,
@@ -50,6 +87,17 @@ type FCreateOp interface {
 	Create(name string, perm uint32) (*File, *p.Error);
 }
 
+// If the FWalkOp interface is implemented on a directory's ops, it is
+// called whenever a client walks to a name that is not already among
+// the directory's children. This lets a backend populate children on
+// demand (e.g. by stat'ing an underlying filesystem) instead of having
+// to build the whole tree up front. The operation should Add() the new
+// File to dir and return it. Returning a nil File and a nil Error is
+// equivalent to "file not found".
+type FWalkOp interface {
+	Walk(dir *File, name string) (*File, *p.Error);
+}
+
 // If the FRemoveOp interface is implemented, the Remove operation will be called
 // when the client attempts to create a file in the File implementing the interface.
 // If not implemented, "permission denied" error will be send back.
@@ -73,13 +121,26 @@ type File struct {
 type FFid struct {
 	file		*File;
 	nextchild	*File;	// used for readdir
+	handle		interface{};	// returned by FOpenOp.Open, if implemented
 }
 
+// File returns the File the fid currently points to. Backends that need
+// to hook into request processing below the File-ops interfaces (e.g. to
+// act on Topen/Tclunk before FOpenOp existed) can use it together with
+// (*File).Ops to get back to their own per-file state.
+func (fid *FFid) File() *File	{ return fid.file }
+
+// Ops returns the opaque value passed as ops to (*File).Add, so that
+// code outside the srv package can recover its own backend type for a
+// File it obtained through Find, FFid.File, or an op callback.
+func (f *File) Ops() interface{}	{ return f.ops }
+
 // The Fsrv can be used to create file servers that serve
 // simple trees of synthetic files.
 type Fsrv struct {
 	Srv;
 	Root	*File;
+	Authsrv	Auth;	// if set, Attach requires afid to pass Authsrv.AuthCheck
 }
 
 var lock sync.Mutex
@@ -181,6 +242,7 @@ func (f *File) Remove() {
 
 	f.next = nil;
 	f.prev = nil;
+	f.parent = nil;
 	p.Unlock();
 }
 
@@ -242,6 +304,21 @@ func (f *File) CheckPerm(user p.User, perm uint32) bool {
 }
 
 func (s *Fsrv) Attach(req *Req) {
+	if s.Authsrv != nil {
+		tc := req.Tc;
+		if err := s.Authsrv.AuthCheck(req.Afid, tc.Uname, tc.Aname); err != nil {
+			req.RespondError(err);
+			return;
+		}
+	}
+
+	// The dialect was already pinned down in Tversion; Attach just
+	// reads it back so the .L-specific handlers in dotl.go know
+	// whether this Conn is allowed to use them.
+	if req.Conn.Version == p.VersionDotl {
+		req.Conn.Dotl = true
+	}
+
 	fid := new(FFid);
 	fid.file = s.Root;
 	req.Fid.Aux = fid;
@@ -273,12 +350,23 @@ func (*Fsrv) Walk(req *Req) {
 			}
 		}
 
-		p := f.Find(tc.Wnames[i]);
-		if p == nil {
+		nf := f.Find(tc.Wnames[i]);
+		if nf == nil {
+			if wop, ok := (f.ops).(FWalkOp); ok {
+				var err *p.Error;
+				nf, err = wop.Walk(f, tc.Wnames[i]);
+				if err != nil {
+					req.RespondError(err);
+					return;
+				}
+			}
+		}
+
+		if nf == nil {
 			break
 		}
 
-		f = p;
+		f = nf;
 		wqids[i] = f.Sqid;
 	}
 
@@ -319,6 +407,16 @@ func (*Fsrv) Open(req *Req) {
 		return;
 	}
 
+	if oop, ok := (fid.file.ops).(FOpenOp); ok {
+		h, err := oop.Open(tc.Mode);
+		if err != nil {
+			req.RespondError(err);
+			return;
+		}
+
+		fid.handle = h;
+	}
+
 	req.RespondRopen(&fid.file.Sqid, 0);
 }
 
@@ -345,14 +443,36 @@ func (*Fsrv) Create(req *Req) {
 	}
 }
 
-func (*Fsrv) Read(req *Req) {
+func (s *Fsrv) Read(req *Req) {
 	var n int;
 	var err *p.Error;
 
-	fid := req.Fid.Aux.(*FFid);
-	f := fid.file;
 	tc := req.Tc;
 	rc := req.Rc;
+
+	fid, ok := req.Fid.Aux.(*FFid);
+	if !ok {
+		// No FFid means req.Fid is an afid from Tauth, not a file fid
+		// from Attach/Walk: run the Tread side of the auth exchange
+		// instead of treating it as a file read.
+		if s.Authsrv == nil {
+			req.RespondError(Eperm);
+			return;
+		}
+
+		p.InitRread(rc, tc.Count);
+		n, err = s.Authsrv.AuthRead(req.Fid, rc.Data);
+		if err != nil {
+			req.RespondError(err);
+			return;
+		}
+
+		p.SetRreadCount(rc, uint32(n));
+		req.Respond();
+		return;
+	}
+
+	f := fid.file;
 	p.InitRread(rc, tc.Count);
 
 	if f.Mode&p.DMDIR != 0 {
@@ -376,7 +496,13 @@ func (*Fsrv) Read(req *Req) {
 		f.Unlock();
 	} else {
 		// file
-		if rop, ok := f.ops.(FReadOp); ok {
+		if rop, ok := f.ops.(FReadAtOp); ok {
+			n, err = rop.ReadAt(fid.handle, rc.Data, tc.Offset);
+			if err != nil {
+				req.RespondError(err);
+				return;
+			}
+		} else if rop, ok := f.ops.(FReadOp); ok {
 			n, err = rop.Read(rc.Data, tc.Offset);
 			if err != nil {
 				req.RespondError(err);
@@ -392,12 +518,38 @@ func (*Fsrv) Read(req *Req) {
 	req.Respond();
 }
 
-func (*Fsrv) Write(req *Req) {
-	fid := req.Fid.Aux.(*FFid);
-	f := fid.file;
+func (s *Fsrv) Write(req *Req) {
 	tc := req.Tc;
 
-	if wop, ok := (f.ops).(FWriteOp); ok {
+	fid, ok := req.Fid.Aux.(*FFid);
+	if !ok {
+		// No FFid means req.Fid is an afid from Tauth, not a file fid
+		// from Attach/Walk: run the Twrite side of the auth exchange
+		// instead of treating it as a file write.
+		if s.Authsrv == nil {
+			req.RespondError(Eperm);
+			return;
+		}
+
+		n, err := s.Authsrv.AuthWrite(req.Fid, tc.Data);
+		if err != nil {
+			req.RespondError(err)
+		} else {
+			req.RespondRwrite(uint32(n))
+		}
+		return;
+	}
+
+	f := fid.file;
+
+	if wop, ok := (f.ops).(FWriteAtOp); ok {
+		n, err := wop.WriteAt(fid.handle, tc.Data, tc.Offset);
+		if err != nil {
+			req.RespondError(err)
+		} else {
+			req.RespondRwrite(uint32(n))
+		}
+	} else if wop, ok := (f.ops).(FWriteOp); ok {
 		n, err := wop.Write(tc.Data, tc.Offset);
 		if err != nil {
 			req.RespondError(err)
@@ -410,7 +562,14 @@ func (*Fsrv) Write(req *Req) {
 
 }
 
-func (*Fsrv) Clunk(req *Req)	{ req.RespondRclunk() }
+func (*Fsrv) Clunk(req *Req) {
+	fid := req.Fid.Aux.(*FFid);
+	if cop, ok := (fid.file.ops).(FClunkOp); ok {
+		cop.Clunk(fid.handle)
+	}
+
+	req.RespondRclunk();
+}
 
 func (*Fsrv) Remove(req *Req) {
 	fid := req.Fid.Aux.(*FFid);
@@ -423,6 +582,22 @@ func (*Fsrv) Remove(req *Req) {
 	}
 	f.Unlock();
 
+	// A backend's Clunk may itself remove the file (e.g. ORCLOSE on a
+	// ufs.File detaches it from the tree already). In that case f has
+	// no parent to remove it from anymore, so skip straight to
+	// Rremove instead of asking FRemoveOp to remove it a second time.
+	if cop, ok := (f.ops).(FClunkOp); ok {
+		if err := cop.Clunk(fid.handle); err != nil {
+			req.RespondError(err);
+			return;
+		}
+
+		if f.parent == nil {
+			req.RespondRremove();
+			return;
+		}
+	}
+
 	if rop, ok := (f.parent.ops).(FRemoveOp); ok {
 		err := rop.Remove(f);
 		if err != nil {
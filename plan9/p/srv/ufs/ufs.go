@@ -0,0 +1,346 @@
+// Copyright 2009 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The ufs package implements a 9P file server that exports a real
+// directory tree from the host filesystem. Every synthetic srv.File
+// the client ever sees corresponds to a real path on disk, and that
+// path is only stat'ed when the client walks to it or reads the
+// directory that holds it.
+package ufs
+
+import "plan9/p";
+import "plan9/p/srv";
+import "os";
+import "path";
+import "strconv";
+import "syscall";
+
+// File is the ufs backend for a single srv.File node: just enough
+// state (the real path, and whether the client asked for ORCLOSE) to
+// service reads, writes and stats against the host filesystem.
+type File struct {
+	srv.File;
+	path	string;
+	remove	bool;	// set by Open when the client passed ORCLOSE
+}
+
+// Ufs serves the directory tree rooted at Root over 9P.
+type Ufs struct {
+	srv.Fsrv;
+	Root	string;
+}
+
+func errno2p(err os.Error) *p.Error {
+	if err == nil {
+		return nil
+	}
+
+	if e, ok := err.(*os.PathError); ok {
+		if errno, ok := e.Err.(os.Errno); ok {
+			return &p.Error{err.String(), uint32(errno)}
+		}
+	}
+
+	if e, ok := err.(os.Errno); ok {
+		return &p.Error{err.String(), uint32(e)}
+	}
+
+	return &p.Error{err.String(), uint32(syscall.EIO)};
+}
+
+// stat2Stat copies a host os.FileInfo into a 9P Stat.
+func stat2Stat(fi *os.FileInfo, st *p.Stat) {
+	st.Sqid.Path = uint64(fi.Ino);
+	st.Sqid.Version = uint32(fi.Mtime_ns);
+	st.Mode = uint32(fi.Permission());
+	if fi.IsDirectory() {
+		st.Sqid.Type = p.QTDIR;
+		st.Mode |= p.DMDIR
+	} else {
+		st.Sqid.Type = p.QTFILE
+	}
+
+	st.Atime = uint32(fi.Atime_ns / 1e9);
+	st.Mtime = uint32(fi.Mtime_ns / 1e9);
+	st.Length = uint64(fi.Size);
+	st.Name = path.Base(fi.Name);
+	st.Uid = strconv.Itoa(fi.Uid);
+	st.Gid = strconv.Itoa(fi.Gid);
+	st.Nuid = uint32(fi.Uid);
+	st.Ngid = uint32(fi.Gid);
+	st.Muid = "";
+}
+
+// newChild builds the synthetic File for fpath, without adding it to
+// any directory yet.
+func newChild(fpath string, fi *os.FileInfo) *File {
+	f := new(File);
+	f.path = fpath;
+	stat2Stat(fi, &f.Stat);
+	return f;
+}
+
+// Walk implements srv.FWalkOp: it lazily mirrors a single path
+// component of the host directory into the synthetic tree the first
+// time a client walks to it.
+func (f *File) Walk(dir *srv.File, name string) (*srv.File, *p.Error) {
+	fpath := path.Join(f.path, name);
+	fi, err := os.Lstat(fpath);
+	if err != nil {
+		if e, ok := err.(*os.PathError); ok && e.Err == os.ENOENT {
+			return nil, nil
+		}
+
+		return nil, errno2p(err);
+	}
+
+	nf := newChild(fpath, fi);
+	if aerr := nf.File.Add(dir, name, nil, nil, nf.Mode, nf); aerr != nil {
+		return nil, aerr
+	}
+
+	// Add() stamps Sqid.Path/Atime/Mtime/Length from its own qid
+	// counter and the current time, clobbering the real values
+	// newChild just filled in from the host. Restat to put them back.
+	if serr := nf.Stat(); serr != nil {
+		return nil, serr
+	}
+
+	return &nf.File, nil;
+}
+
+// Create implements srv.FCreateOp.
+func (f *File) Create(name string, perm uint32) (*srv.File, *p.Error) {
+	fpath := path.Join(f.path, name);
+	var err os.Error;
+
+	if perm&p.DMDIR != 0 {
+		err = os.Mkdir(fpath, uint32(perm&0777))
+	} else {
+		var file *os.File;
+		file, err = os.OpenFile(fpath, os.O_CREAT|os.O_EXCL|os.O_RDWR, uint32(perm&0777));
+		if file != nil {
+			file.Close()
+		}
+	}
+
+	if err != nil {
+		return nil, errno2p(err)
+	}
+
+	fi, err := os.Lstat(fpath);
+	if err != nil {
+		return nil, errno2p(err)
+	}
+
+	nf := newChild(fpath, fi);
+	if aerr := nf.File.Add(&f.File, name, nil, nil, nf.Mode, nf); aerr != nil {
+		return nil, aerr
+	}
+
+	// Same reset-on-Add issue as Walk: restat so Sqid/Atime/Mtime/
+	// Length reflect the file we just created, not Add()'s defaults.
+	if serr := nf.Stat(); serr != nil {
+		return nil, serr
+	}
+
+	return &nf.File, nil;
+}
+
+// Remove implements srv.FRemoveOp. It is called on the parent
+// directory's ops with the child being removed.
+func (f *File) Remove(child *srv.File) *p.Error {
+	cf := child.Ops().(*File);
+	if err := os.Remove(cf.path); err != nil {
+		return errno2p(err)
+	}
+
+	return nil;
+}
+
+// Stat implements srv.FStatOp.
+func (f *File) Stat() *p.Error {
+	fi, err := os.Lstat(f.path);
+	if err != nil {
+		return errno2p(err)
+	}
+
+	stat2Stat(fi, &f.Stat);
+	return nil;
+}
+
+// Wstat implements srv.FWstatOp. Only mode and rename are supported,
+// mirroring what the host filesystem can actually express.
+func (f *File) Wstat(st *p.Stat) *p.Error {
+	if st.Mode != 0xFFFFFFFF {
+		if err := os.Chmod(f.path, uint32(st.Mode&0777)); err != nil {
+			return errno2p(err)
+		}
+	}
+
+	if st.Name != "" && st.Name != f.Name {
+		newpath := path.Join(path.Dir(f.path), st.Name);
+		if err := os.Rename(f.path, newpath); err != nil {
+			return errno2p(err)
+		}
+
+		f.path = newpath;
+	}
+
+	return nil;
+}
+
+// Open implements srv.FOpenOp: it opens the host file in the
+// requested mode, truncating immediately if OTRUNC was set, and
+// remembers ORCLOSE so Clunk can remove the file afterwards. The
+// returned *os.File is the handle threaded through ReadAt/WriteAt/Clunk.
+func (f *File) Open(mode uint8) (interface{}, *p.Error) {
+	var flags int;
+	switch mode & 3 {
+	case p.OREAD:
+		flags = os.O_RDONLY
+	case p.OWRITE:
+		flags = os.O_WRONLY
+	case p.ORDWR:
+		flags = os.O_RDWR
+	}
+
+	if mode&p.OTRUNC != 0 {
+		flags |= os.O_TRUNC
+	}
+
+	file, err := os.OpenFile(f.path, flags, 0);
+	if err != nil {
+		return nil, errno2p(err)
+	}
+
+	if mode&p.ORCLOSE != 0 {
+		f.remove = true
+	}
+
+	return file, nil;
+}
+
+// ReadAt implements srv.FReadAtOp using the handle produced by Open.
+func (f *File) ReadAt(h interface{}, buf []byte, offset uint64) (int, *p.Error) {
+	file, _ := h.(*os.File);
+	if file == nil {
+		return 0, srv.Eperm
+	}
+
+	n, err := file.ReadAt(buf, int64(offset));
+	if err != nil && err != os.EOF {
+		return 0, errno2p(err)
+	}
+
+	return n, nil;
+}
+
+// WriteAt implements srv.FWriteAtOp using the handle produced by Open.
+func (f *File) WriteAt(h interface{}, data []byte, offset uint64) (int, *p.Error) {
+	file, _ := h.(*os.File);
+	if file == nil {
+		return 0, srv.Eperm
+	}
+
+	n, err := file.WriteAt(data, int64(offset));
+	if err != nil {
+		return 0, errno2p(err)
+	}
+
+	return n, nil;
+}
+
+// Clunk implements srv.FClunkOp: it closes the handle produced by
+// Open and, if the client passed ORCLOSE, removes the host file and
+// drops it from the synthetic tree.
+func (f *File) Clunk(h interface{}) *p.Error {
+	if file, ok := h.(*os.File); ok && file != nil {
+		file.Close()
+	}
+
+	if f.remove {
+		if err := os.Remove(f.path); err != nil {
+			return errno2p(err)
+		}
+
+		f.File.Remove();
+	}
+
+	return nil;
+}
+
+// populate mirrors every entry of the host directory backing f into
+// the synthetic tree, so a plain directory Read sees the real
+// listing instead of only whichever children an earlier Twalk
+// happened to name one at a time.
+func (u *Ufs) populate(f *srv.File) *p.Error {
+	uf := f.Ops().(*File);
+	dir, err := os.Open(uf.path);
+	if err != nil {
+		return errno2p(err)
+	}
+
+	defer dir.Close();
+	names, rerr := dir.Readdirnames(-1);
+	if rerr != nil {
+		return errno2p(rerr)
+	}
+
+	for _, name := range names {
+		if f.Find(name) != nil {
+			continue
+		}
+
+		if _, werr := uf.Walk(f, name); werr != nil {
+			return werr
+		}
+	}
+
+	return nil;
+}
+
+// Read overrides Fsrv.Read: for a directory, it first populates any
+// host entries the synthetic tree doesn't know about yet, then
+// defers to Fsrv.Read to pack whatever is now there. Files are
+// untouched; Fsrv.Read already reaches FReadAtOp for those.
+func (u *Ufs) Read(req *srv.Req) {
+	fid := req.Fid.Aux.(*srv.FFid);
+	f := fid.File();
+	if f.Mode&p.DMDIR != 0 {
+		if err := u.populate(f); err != nil {
+			req.RespondError(err);
+			return;
+		}
+	}
+
+	u.Fsrv.Read(req);
+}
+
+// StartServer exports root over 9P on addr. If debug is true, every
+// Fcall is logged as it is processed.
+func StartServer(root, addr string, debug bool) os.Error {
+	fi, err := os.Lstat(root);
+	if err != nil {
+		return err
+	}
+
+	rf := newChild(root, fi);
+	rf.File.Add(nil, "/", nil, nil, rf.Mode, rf);
+
+	u := new(Ufs);
+	u.Root = root;
+	u.Fsrv.Root = &rf.File;
+	u.Dotu = true;
+	u.Debuglevel = 0;
+	if debug {
+		u.Debuglevel = 1
+	}
+
+	if !u.Start(u) {
+		return os.NewError("ufs: srv.Start failed")
+	}
+
+	return u.StartNetListener("tcp", addr);
+}
@@ -0,0 +1,93 @@
+// Copyright 2009 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ufs
+
+import "io/ioutil"
+import "os"
+import "testing"
+
+// TestWalkPreservesStat guards against Add() clobbering the real host
+// attributes newChild just read from disk: a client that walks to a
+// file should see its actual size and mtime, not the zero/now
+// defaults Add() stamps on every new File.
+func TestWalkPreservesStat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ufs_test");
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir);
+
+	const content = "hello ufs";
+	fpath := dir + "/child";
+	if err := ioutil.WriteFile(fpath, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	fi, err := os.Lstat(dir);
+	if err != nil {
+		t.Fatalf("Lstat(%s): %v", dir, err)
+	}
+
+	root := newChild(dir, fi);
+	root.File.Add(nil, "/", nil, nil, root.Mode, root);
+
+	child, werr := root.Walk(&root.File, "child");
+	if werr != nil {
+		t.Fatalf("Walk: %v", werr)
+	}
+
+	if child.Length != uint64(len(content)) {
+		t.Fatalf("Length = %d, want %d (Add() clobbered the real size)", child.Length, len(content))
+	}
+
+	cfi, err := os.Lstat(fpath);
+	if err != nil {
+		t.Fatalf("Lstat(%s): %v", fpath, err)
+	}
+
+	if child.Atime != uint32(cfi.Atime_ns/1e9) || child.Mtime != uint32(cfi.Mtime_ns/1e9) {
+		t.Fatalf("Atime/Mtime = %d/%d, want the host's %d/%d (Add() clobbered them with the current time)", child.Atime, child.Mtime, cfi.Atime_ns/1e9, cfi.Mtime_ns/1e9)
+	}
+}
+
+// TestPopulateListsHostDir ensures every entry of the host directory
+// is reachable after populate, not just whichever ones an earlier
+// Walk happened to name -- the bug that made plain directory reads
+// come back empty.
+func TestPopulateListsHostDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ufs_test");
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir);
+
+	names := []string{"a", "b", "c"};
+	for _, name := range names {
+		if err := ioutil.WriteFile(dir+"/"+name, []byte(name), 0644); err != nil {
+			t.Fatalf("WriteFile(%s): %v", name, err)
+		}
+	}
+
+	fi, err := os.Lstat(dir);
+	if err != nil {
+		t.Fatalf("Lstat(%s): %v", dir, err)
+	}
+
+	root := newChild(dir, fi);
+	root.File.Add(nil, "/", nil, nil, root.Mode, root);
+
+	u := new(Ufs);
+	u.Fsrv.Root = &root.File;
+
+	if perr := u.populate(&root.File); perr != nil {
+		t.Fatalf("populate: %v", perr)
+	}
+
+	for _, name := range names {
+		if root.File.Find(name) == nil {
+			t.Fatalf("populate didn't add %q", name)
+		}
+	}
+}